@@ -0,0 +1,38 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "testing"
+
+func TestParseMemoryLimit(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"256m", 256 * 1024 * 1024, false},
+		{"1g", 1024 * 1024 * 1024, false},
+		{"512k", 512 * 1024, false},
+		{"1024", 1024, false},
+		{" 256M ", 256 * 1024 * 1024, false},
+		{"not-a-number", 0, true},
+	}
+
+	for _, tc := range cases {
+		got, err := parseMemoryLimit(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseMemoryLimit(%q) expected error, got nil", tc.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMemoryLimit(%q) returned error: %v", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseMemoryLimit(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+}
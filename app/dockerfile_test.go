@@ -0,0 +1,76 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseDockerfile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "Dockerfile")
+	content := "FROM alpine:3.19\n# a comment\n\nRUN echo hi\nCMD [\"/bin/sh\"]\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("write Dockerfile: %v", err)
+	}
+
+	want := []dockerfileInstruction{
+		{Op: "FROM", Args: "alpine:3.19"},
+		{Op: "RUN", Args: "echo hi"},
+		{Op: "CMD", Args: `["/bin/sh"]`},
+	}
+
+	got, err := parseDockerfile(path)
+	if err != nil {
+		t.Fatalf("parseDockerfile returned error: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDockerfile = %+v, want %+v", got, want)
+	}
+}
+
+func TestNormalizeEnvArg(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"KEY=value", "KEY=value"},
+		{"KEY value", "KEY=value"},
+		{"KEY  value with spaces", "KEY=value with spaces"},
+	}
+	for _, tc := range cases {
+		if got := normalizeEnvArg(tc.in); got != tc.want {
+			t.Errorf("normalizeEnvArg(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseCmdLike(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []string
+	}{
+		{`["/bin/echo", "hi"]`, []string{"/bin/echo", "hi"}},
+		{"echo hi", []string{"/bin/sh", "-c", "echo hi"}},
+	}
+	for _, tc := range cases {
+		got := parseCmdLike(tc.in)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseCmdLike(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSanitizeImageRef(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"myapp:latest", "myapp_latest"},
+		{"ghcr.io/org/myapp:v1", "ghcr.io_org_myapp_v1"},
+		{"myapp@sha256:abc", "myapp_sha256_abc"},
+	}
+	for _, tc := range cases {
+		if got := sanitizeImageRef(tc.in); got != tc.want {
+			t.Errorf("sanitizeImageRef(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "testing"
+
+func TestParseImageReference(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want ImageReference
+	}{
+		{"bare name defaults to library and latest", "ubuntu", ImageReference{Registry: defaultRegistry, Repository: "library/ubuntu", Tag: "latest"}},
+		{"namespaced repo keeps default registry", "library/ubuntu:22.04", ImageReference{Registry: defaultRegistry, Repository: "library/ubuntu", Tag: "22.04"}},
+		{"third-party registry host", "ghcr.io/library/ubuntu:latest", ImageReference{Registry: "ghcr.io", Repository: "library/ubuntu", Tag: "latest"}},
+		{"registry with port", "localhost:5000/myimage:v1", ImageReference{Registry: "localhost:5000", Repository: "myimage", Tag: "v1"}},
+		{"digest pin", "ubuntu@sha256:abc", ImageReference{Registry: defaultRegistry, Repository: "library/ubuntu", Tag: "latest", Digest: "sha256:abc"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseImageReference(tc.in)
+			if err != nil {
+				t.Fatalf("parseImageReference(%q) returned error: %v", tc.in, err)
+			}
+			if got != tc.want {
+				t.Errorf("parseImageReference(%q) = %+v, want %+v", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseImageReferenceEmptyRepository(t *testing.T) {
+	if _, err := parseImageReference(""); err == nil {
+		t.Error("parseImageReference(\"\") should return an error")
+	}
+}
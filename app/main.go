@@ -5,8 +5,14 @@ package main
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
@@ -14,10 +20,39 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
+// maxConcurrentLayerPulls bounds how many layer blobs are downloaded at once.
+const maxConcurrentLayerPulls = 4
+
+// cgroupRoot is where per-container cgroup v2 slices are created.
+const cgroupRoot = "/sys/fs/cgroup/mini-docker"
+
+// defaultRegistry is used when the image reference doesn't specify one explicitly,
+// matching Docker Hub's pull endpoint (distinct from the web-facing hub.docker.com host).
+const defaultRegistry = "registry-1.docker.io"
+
+// containersDirName and imagesDirName hold, respectively, each run's rootfs/upperdir (so
+// `commit` can snapshot it after the container exits) and the OCI image layouts `commit` and
+// `build` produce, both rooted under ~/.mini-docker.
+const (
+	containersDirName = "containers"
+	imagesDirName     = "images"
+)
+
+// ImageReference is a parsed `[registry[:port]/]repo[/subrepo]:tag[@digest]` string.
+type ImageReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
 type ManifestList struct {
 	SchemaVersion int    `json:"schemaVersion"`
 	MediaType     string `json:"mediaType"`
@@ -32,6 +67,11 @@ type ManifestList struct {
 }
 
 type Manifest struct {
+	Config struct {
+		Digest    string `json:"digest"`
+		Size      int    `json:"size"`
+		MediaType string `json:"mediaType"`
+	} `json:"config"`
 	Layers []struct {
 		Digest    string `json:"digest"`
 		Size      int    `json:"size"`
@@ -39,62 +79,225 @@ type Manifest struct {
 	} `json:"layers"`
 }
 
+// ImageConfig is the image config blob referenced by a manifest's `config.digest`, per the
+// OCI image-spec (https://github.com/opencontainers/image-spec/blob/main/config.md).
+type ImageConfig struct {
+	Architecture string `json:"architecture,omitempty"`
+	OS           string `json:"os,omitempty"`
+	Config       struct {
+		Entrypoint   []string            `json:"Entrypoint"`
+		Cmd          []string            `json:"Cmd"`
+		Env          []string            `json:"Env"`
+		WorkingDir   string              `json:"WorkingDir"`
+		User         string              `json:"User"`
+		Volumes      map[string]struct{} `json:"Volumes"`
+		ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []ImageHistoryEntry `json:"history,omitempty"`
+}
+
+// ImageHistoryEntry records one layer's provenance in an image config's `history` array.
+type ImageHistoryEntry struct {
+	Created    string `json:"created,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	Comment    string `json:"comment,omitempty"`
+	EmptyLayer bool   `json:"empty_layer,omitempty"`
+}
+
+// OCIImageIndex is the top-level `index.json` of an OCI image layout.
+type OCIImageIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []OCIDescriptor `json:"manifests"`
+}
+
+// OCIDescriptor is a content-addressable pointer to a blob, as used throughout the image-spec.
+type OCIDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+// OCIManifest is the manifest blob an index.json entry points at.
+type OCIManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        OCIDescriptor   `json:"config"`
+	Layers        []OCIDescriptor `json:"layers"`
+}
+
+// manifestAcceptHeader lists the media types accepted when negotiating manifests, covering both Docker v2 and OCI image-spec.
+var manifestAcceptHeader = strings.Join([]string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}, ",")
+
 func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
 
-	// Check input validity
-	if len(os.Args) < 4 || os.Args[1] != "run" {
-		fmt.Fprintf(os.Stderr, "\nuse: run <image> <command> <arg1> <arg2> .... <argN>")
-		os.Exit(1)
+	switch os.Args[1] {
+	case "run":
+		runCommand(os.Args[2:])
+	case "init":
+		// Re-exec trampoline target: never invoked directly by a user, only by runCommand and
+		// runBuildStep via /proc/self/exe once the new namespaces have been unshared.
+		initCommand(os.Args[2:])
+	case "commit":
+		commitCommand(os.Args[2:])
+	case "build":
+		buildCommand(os.Args[2:])
+	default:
+		usage()
 	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "\nuse:\n"+
+		"  run [--memory=<bytes>] [--cpus=<n>] [--pids=<n>] [--entrypoint=<cmd>] <image> [command] [arg1] [arg2] .... [argN]\n"+
+		"  commit <container-id> <newimage:tag>\n"+
+		"  build [-t <image:tag>] <Dockerfile>\n")
+	os.Exit(1)
+}
 
-	// Get command and arguments
-	command := os.Args[3]
-	args := os.Args[4:len(os.Args)]
+// runCommand resolves and pulls the image, builds the rootfs, and re-execs as init inside new namespaces
+func runCommand(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	memory := fs.String("memory", "", "memory limit, e.g. 256m, 1g")
+	cpus := fs.Float64("cpus", 0, "number of CPUs, e.g. 1.5")
+	pids := fs.Int("pids", 0, "max number of pids")
+	entrypointFlag := fs.String("entrypoint", "", "override the image's ENTRYPOINT")
+	fs.Parse(args)
+
+	rest := fs.Args()
+	if len(rest) < 1 {
+		usage()
+	}
 
-	// Get image name and version
-	imageName, imageVersion, err := getImageNameAndVersion(os.Args[2])
+	// Parse the image reference (registry, repository, tag, optional digest)
+	ref, err := parseImageReference(rest[0])
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to extract image: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Failed to parse image reference: %v\n", err)
 		os.Exit(1)
 	}
 
 	// Get Auth token
-	token, err := getAuthToken(imageName)
+	token, err := getAuthToken(ref)
 	if err != nil {
 		fmt.Fprint(os.Stderr, "Auth failed: ", err)
 		os.Exit(1)
 	}
 
 	// Get Manifest for Image
-	manifest, err := getImageManifest(imageName, imageVersion, token)
+	manifest, err := getImageManifest(ref, token)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Get manifest failed: ", err)
 		os.Exit(1)
 	}
 
-	// CHROOT ISOLATION
+	// Get the image config (ENTRYPOINT, CMD, ENV, WORKDIR, USER, ...)
+	imageConfig, rawImageConfig, err := fetchImageConfig(ref, token, manifest.Config.Digest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Get image config failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Merge the image's ENTRYPOINT/CMD with CLI overrides the way Docker does: a user-supplied
+	// command replaces CMD but leaves ENTRYPOINT alone unless --entrypoint was also passed.
+	entrypoint := imageConfig.Config.Entrypoint
+	if *entrypointFlag != "" {
+		entrypoint = []string{*entrypointFlag}
+	}
+	cmdOverride := imageConfig.Config.Cmd
+	if userCmd := rest[1:]; len(userCmd) > 0 {
+		cmdOverride = userCmd
+	}
+
+	fullCommand := append(append([]string{}, entrypoint...), cmdOverride...)
+	if len(fullCommand) == 0 {
+		fmt.Fprintf(os.Stderr, "no command specified and image provides no ENTRYPOINT/CMD\n")
+		os.Exit(1)
+	}
+	command := fullCommand[0]
+	cmdArgs := fullCommand[1:]
+
+	containerID, err := generateContainerID()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate container id: %v\n", err)
+		os.Exit(1)
+	}
+
+	// OVERLAYFS ROOTFS
 
-	// Create temp chroot jail directory
-	chrootDir, err := os.MkdirTemp("", "mydocker-jail")
+	// Container state lives under ~/.mini-docker/containers/<id>/ rather than a temp dir that
+	// gets wiped on exit: `commit` needs to read back upperDir (and the pulled manifest/config)
+	// after the container has already stopped.
+	rootDir, err := containerDir(containerID)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create chroot dr: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Failed to resolve container dir: %v\n", err)
 		os.Exit(1)
 	}
 
-	defer os.RemoveAll(chrootDir)
+	layersDir := filepath.Join(rootDir, "layers")
+	upperDir := filepath.Join(rootDir, "upper")
+	workDir := filepath.Join(rootDir, "work")
+	chrootDir := filepath.Join(rootDir, "merged")
+	for _, dir := range []string{layersDir, upperDir, workDir, chrootDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create %s: %v\n", dir, err)
+			os.Exit(1)
+		}
+	}
+
+	// Persist the manifest and raw image config alongside the container so `commit` can later
+	// rebuild a proper history/diff_id chain without re-pulling from the registry.
+	rawManifest, err := json.Marshal(manifest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to marshal manifest: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(filepath.Join(rootDir, "manifest.json"), rawManifest, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to persist manifest: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(filepath.Join(rootDir, "config.json"), rawImageConfig, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to persist image config: %v\n", err)
+		os.Exit(1)
+	}
 
-	// Extract all image layers inside chroot directory
-	err = getAllLayers(manifest, imageName, token, chrootDir)
+	// Extract all image layers, each into its own directory
+	layerDirs, err := getAllLayers(manifest, ref, token, layersDir)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Get all layers failed: ", err)
 		os.Exit(1)
 	}
 
+	// Mount the overlay: lowerdir lists layers topmost-first (manifest order is bottom-to-top),
+	// upperdir is the container's writable layer, merged is what actually gets chrooted into.
+	if err := mountOverlay(reverseStrings(layerDirs), upperDir, workDir, chrootDir); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to mount overlay rootfs: %v\n", err)
+		os.Exit(1)
+	}
+	// Unmounting leaves upperDir intact on disk, so `commit` can still snapshot it once the
+	// container has exited; only the mount itself is torn down here.
+	defer unmountOverlay(chrootDir)
 
 	// Check if command (its path) exist inside chroot directory - if it comes with the image
 	destPath := filepath.Join(chrootDir, command)
 	if _, err := os.Stat(destPath); os.IsNotExist(err) {
-		// If the path of command doesn't exist inside our chroot - we have to copy it from host 
+		// If the path of command doesn't exist inside our chroot - we have to copy it from host
 
 		// Compute destination path inside chroot:
 		// filepath.Join - joins rootpath + command - chrootDir + command (/tmp/mydocker-jail + /usr/local/bin/docker-explorer)
@@ -109,59 +312,894 @@ func main() {
 			fmt.Fprintf(os.Stderr, "Failed to copy binary: %v\n", err)
 			os.Exit(1)
 		}
-	} else if err != nil {
-		fmt.Fprint(os.Stderr, "Failed to check if binary exists in image: %v\n", err)
-		os.Exit(1)
+	} else if err != nil {
+		fmt.Fprint(os.Stderr, "Failed to check if binary exists in image: %v\n", err)
+		os.Exit(1)
+	}
+
+	// CGROUP V2 RESOURCE LIMITS
+
+	cgroupPath, err := setupCgroup(containerID, *memory, *cpus, *pids)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up cgroup: %v\n", err)
+		os.Exit(1)
+	}
+	defer teardownCgroup(cgroupPath)
+
+	fmt.Fprintf(os.Stderr, "container id: %s\n", containerID)
+
+	// NAMESPACE ISOLATION (re-exec trampoline)
+
+	// Re-exec ourselves as "init" inside freshly unshared namespaces; the init process performs
+	// the chroot/proc-mount setup once inside those namespaces, then runs the user command as
+	// its child and waits for it.
+	trampolineArgs := append([]string{"init", chrootDir, command}, cmdArgs...)
+	cmd := exec.Command("/proc/self/exe", trampolineArgs...)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	cmd.Stdin = os.Stdin
+
+	// Hand the image's ENV/WORKDIR/USER down to the init process via the environment, since the
+	// re-exec'd process does not have the image config; init applies them once inside the chroot.
+	cmd.Env = append(os.Environ(),
+		"MINI_DOCKER_ENV="+strings.Join(imageConfig.Config.Env, "\n"),
+		"MINI_DOCKER_WORKDIR="+imageConfig.Config.WorkingDir,
+		"MINI_DOCKER_USER="+imageConfig.Config.User,
+	)
+
+	// The id map covers the full uid/gid range (not just root) so initCommand's Credential-based
+	// switch to an arbitrary in-image USER still lands inside this user namespace.
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS |
+			syscall.CLONE_NEWIPC | syscall.CLONE_NEWNET | syscall.CLONE_NEWUSER,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: 0, Size: 65536}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: 0, Size: 65536}},
+	}
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start container: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Move the child into its cgroup before it gets a chance to spawn anything further.
+	if cgroupPath != "" {
+		if err := os.WriteFile(filepath.Join(cgroupPath, "cgroup.procs"), []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to move container into cgroup: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		unmountOverlay(chrootDir)
+		teardownCgroup(cgroupPath)
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		os.Exit(1)
+	}
+}
+
+// initCommand runs inside the namespaces unshared by runCommand or runBuildStep, finishes rootfs setup, and runs the user's command as a child process
+func initCommand(args []string) {
+	if len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "init: missing chroot dir or command\n")
+		os.Exit(1)
+	}
+	chrootDir := args[0]
+	command := args[1]
+	cmdArgs := args[2:]
+
+	env := os.Getenv("MINI_DOCKER_ENV")
+	workDir := os.Getenv("MINI_DOCKER_WORKDIR")
+	user := os.Getenv("MINI_DOCKER_USER")
+
+	if err := syscall.Chroot(chrootDir); err != nil {
+		fmt.Fprintf(os.Stderr, "Chroot failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := os.Chdir("/"); err != nil {
+		fmt.Fprintf(os.Stderr, "Chdir failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := os.MkdirAll("/proc", 0555); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create /proc: %v\n", err)
+		os.Exit(1)
+	}
+	if err := syscall.Mount("proc", "/proc", "proc", 0, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to mount /proc: %v\n", err)
+		os.Exit(1)
+	}
+
+	cmd := exec.Command(command, cmdArgs...)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	cmd.Stdin = os.Stdin
+	if env != "" {
+		cmd.Env = strings.Split(env, "\n")
+	} else {
+		cmd.Env = []string{}
+	}
+	if workDir != "" {
+		cmd.Dir = workDir
+	}
+
+	if user != "" {
+		uid, gid, err := resolveUser(user)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to resolve user %q: %v\n", user, err)
+			os.Exit(1)
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+		}
+	}
+
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		fmt.Fprintf(os.Stderr, "Exec failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// commitCommand snapshots a container's upperdir into a new layer and writes an OCI image layout
+func commitCommand(args []string) {
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "use: commit <container-id> <newimage:tag>\n")
+		os.Exit(1)
+	}
+	containerID, newRef := args[0], args[1]
+
+	home, err := miniDockerHome()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to resolve mini-docker home: %v\n", err)
+		os.Exit(1)
+	}
+
+	dir := filepath.Join(home, containersDirName, containerID)
+	if _, err := os.Stat(dir); err != nil {
+		fmt.Fprintf(os.Stderr, "container %s not found: %v\n", containerID, err)
+		os.Exit(1)
+	}
+
+	var baseManifest Manifest
+	rawManifest, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read container manifest: %v\n", err)
+		os.Exit(1)
+	}
+	if err := json.Unmarshal(rawManifest, &baseManifest); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse container manifest: %v\n", err)
+		os.Exit(1)
+	}
+
+	baseConfig := map[string]interface{}{}
+	if rawConfig, err := os.ReadFile(filepath.Join(dir, "config.json")); err == nil && len(rawConfig) > 0 {
+		if err := json.Unmarshal(rawConfig, &baseConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse container config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	layerGz, diffID, err := tarGzDir(filepath.Join(dir, "upper"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to snapshot container changes: %v\n", err)
+		os.Exit(1)
+	}
+	layerDigest := digestOf(layerGz)
+
+	appendHistory(baseConfig, diffID, "mini-docker commit")
+
+	newConfigBytes, err := json.Marshal(baseConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to marshal new image config: %v\n", err)
+		os.Exit(1)
+	}
+
+	layers := make([]ociLayerBlob, 0, len(baseManifest.Layers)+1)
+	for _, l := range baseManifest.Layers {
+		cachePath, err := layerCachePath(l.Digest)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to resolve cached layer %s: %v\n", l.Digest, err)
+			os.Exit(1)
+		}
+		data, err := os.ReadFile(cachePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read cached layer %s: %v\n", l.Digest, err)
+			os.Exit(1)
+		}
+		layers = append(layers, ociLayerBlob{Digest: l.Digest, Data: data})
+	}
+	layers = append(layers, ociLayerBlob{Digest: layerDigest, Data: layerGz})
+
+	imageDir, err := writeOCIImageLayout(newRef, newConfigBytes, layers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write image layout: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(imageDir)
+}
+
+// dockerfileInstruction is one parsed line of a Dockerfile: an instruction keyword and its
+// (unparsed) argument string.
+type dockerfileInstruction struct {
+	Op   string
+	Args string
+}
+
+// parseDockerfile parses the minimal Dockerfile grammar buildCommand understands
+func parseDockerfile(path string) ([]dockerfileInstruction, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var instructions []dockerfileInstruction
+	for _, rawLine := range strings.Split(string(data), "\n") {
+		line := strings.TrimSpace(rawLine)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		instr := dockerfileInstruction{Op: strings.ToUpper(parts[0])}
+		if len(parts) > 1 {
+			instr.Args = strings.TrimSpace(parts[1])
+		}
+		instructions = append(instructions, instr)
+	}
+
+	return instructions, nil
+}
+
+// buildCommand executes a minimal Dockerfile and produces an OCI image layout: the base image's layers plus one layer per RUN, COPY or ADD instruction
+func buildCommand(args []string) {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	tag := fs.String("t", "", "name and tag for the built image")
+	fs.Parse(args)
+
+	dockerfilePath := "Dockerfile"
+	if rest := fs.Args(); len(rest) > 0 {
+		dockerfilePath = rest[0]
+	}
+	buildContext := filepath.Dir(dockerfilePath)
+
+	instructions, err := parseDockerfile(dockerfilePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", dockerfilePath, err)
+		os.Exit(1)
+	}
+
+	var layerDirs []string
+	var cleanupDirs []string
+	defer func() {
+		for _, d := range cleanupDirs {
+			os.RemoveAll(d)
+		}
+	}()
+
+	var cfg ImageConfig
+	fromSeen := false
+
+	for _, instr := range instructions {
+		switch instr.Op {
+		case "FROM":
+			if fromSeen {
+				fmt.Fprintf(os.Stderr, "build: multiple FROM instructions are not supported\n")
+				os.Exit(1)
+			}
+			fromSeen = true
+
+			ref, err := parseImageReference(instr.Args)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "build: FROM %s: %v\n", instr.Args, err)
+				os.Exit(1)
+			}
+			token, err := getAuthToken(ref)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "build: FROM %s: auth failed: %v\n", instr.Args, err)
+				os.Exit(1)
+			}
+			manifest, err := getImageManifest(ref, token)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "build: FROM %s: get manifest failed: %v\n", instr.Args, err)
+				os.Exit(1)
+			}
+			imageConfig, _, err := fetchImageConfig(ref, token, manifest.Config.Digest)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "build: FROM %s: get image config failed: %v\n", instr.Args, err)
+				os.Exit(1)
+			}
+			cfg = imageConfig
+
+			baseLayersDir, err := os.MkdirTemp("", "mini-docker-build-base")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "build: %v\n", err)
+				os.Exit(1)
+			}
+			cleanupDirs = append(cleanupDirs, baseLayersDir)
+
+			layerDirs, err = getAllLayers(manifest, ref, token, baseLayersDir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "build: FROM %s: get all layers failed: %v\n", instr.Args, err)
+				os.Exit(1)
+			}
+
+		case "RUN":
+			requireFrom(fromSeen, instr.Op)
+			upperDir, rootDir, err := runBuildStep(layerDirs, cfg, instr.Args)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "build: %v\n", err)
+				os.Exit(1)
+			}
+			cleanupDirs = append(cleanupDirs, rootDir)
+			layerDirs = append(layerDirs, upperDir)
+
+		case "COPY", "ADD":
+			requireFrom(fromSeen, instr.Op)
+			layerDir, err := applyCopyInstruction(instr.Args, buildContext)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "build: %s %s: %v\n", instr.Op, instr.Args, err)
+				os.Exit(1)
+			}
+			cleanupDirs = append(cleanupDirs, layerDir)
+			layerDirs = append(layerDirs, layerDir)
+
+		case "ENV":
+			cfg.Config.Env = append(cfg.Config.Env, normalizeEnvArg(instr.Args))
+		case "WORKDIR":
+			cfg.Config.WorkingDir = instr.Args
+		case "USER":
+			cfg.Config.User = instr.Args
+		case "CMD":
+			cfg.Config.Cmd = parseCmdLike(instr.Args)
+		case "ENTRYPOINT":
+			cfg.Config.Entrypoint = parseCmdLike(instr.Args)
+		default:
+			fmt.Fprintf(os.Stderr, "build: skipping unsupported instruction %q\n", instr.Op)
+		}
+	}
+
+	if !fromSeen {
+		fmt.Fprintf(os.Stderr, "build: Dockerfile has no FROM instruction\n")
+		os.Exit(1)
+	}
+
+	imageName := *tag
+	if imageName == "" {
+		imageName = "mini-docker-build:latest"
+	}
+
+	layers := make([]ociLayerBlob, 0, len(layerDirs))
+	diffIDs := make([]string, 0, len(layerDirs))
+	for _, dir := range layerDirs {
+		gzBytes, diffID, err := tarGzDir(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "build: failed to tar layer %s: %v\n", dir, err)
+			os.Exit(1)
+		}
+		layers = append(layers, ociLayerBlob{Digest: digestOf(gzBytes), Data: gzBytes})
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	configBytes, err := json.Marshal(map[string]interface{}{
+		"architecture": runtime.GOARCH,
+		"os":           runtime.GOOS,
+		"config":       cfg.Config,
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+		"history":      instructionHistory(instructions),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "build: failed to marshal image config: %v\n", err)
+		os.Exit(1)
+	}
+
+	imageDir, err := writeOCIImageLayout(imageName, configBytes, layers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "build: failed to write image layout: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(imageDir)
+}
+
+// requireFrom exits with an error if a non-FROM instruction appears before any FROM.
+func requireFrom(fromSeen bool, op string) {
+	if !fromSeen {
+		fmt.Fprintf(os.Stderr, "build: %s before FROM\n", op)
+		os.Exit(1)
+	}
+}
+
+// runBuildStep executes a RUN instruction in a throwaway container and returns the resulting upperdir as a new layer
+func runBuildStep(layerDirs []string, cfg ImageConfig, shellCmd string) (string, string, error) {
+	rootDir, err := os.MkdirTemp("", "mini-docker-build-step")
+	if err != nil {
+		return "", "", err
+	}
+
+	upperDir := filepath.Join(rootDir, "upper")
+	workDir := filepath.Join(rootDir, "work")
+	mergedDir := filepath.Join(rootDir, "merged")
+	for _, d := range []string{upperDir, workDir, mergedDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return "", "", err
+		}
+	}
+
+	if err := mountOverlay(reverseStrings(layerDirs), upperDir, workDir, mergedDir); err != nil {
+		return "", "", fmt.Errorf("mount overlay for RUN step: %w", err)
+	}
+	defer unmountOverlay(mergedDir)
+
+	cmd := exec.Command("/proc/self/exe", "init", mergedDir, "/bin/sh", "-c", shellCmd)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+	cmd.Env = append(os.Environ(),
+		"MINI_DOCKER_ENV="+strings.Join(cfg.Config.Env, "\n"),
+		"MINI_DOCKER_WORKDIR="+cfg.Config.WorkingDir,
+		"MINI_DOCKER_USER="+cfg.Config.User,
+	)
+	// The id map covers the full uid/gid range (not just root) so initCommand's Credential-based
+	// switch to an arbitrary in-image USER still lands inside this user namespace.
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS |
+			syscall.CLONE_NEWIPC | syscall.CLONE_NEWNET | syscall.CLONE_NEWUSER,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: 0, Size: 65536}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: 0, Size: 65536}},
+	}
+
+	if err := cmd.Run(); err != nil {
+		return "", "", fmt.Errorf("RUN %q: %w", shellCmd, err)
+	}
+
+	return upperDir, rootDir, nil
+}
+
+// applyCopyInstruction stages a COPY/ADD source into its own fresh layer directory
+func applyCopyInstruction(argsStr, buildContext string) (string, error) {
+	fields := strings.Fields(argsStr)
+	if len(fields) != 2 {
+		return "", fmt.Errorf("only a single <src> <dest> is supported, got %q", argsStr)
+	}
+	src, dest := fields[0], fields[1]
+
+	layerDir, err := os.MkdirTemp("", "mini-docker-build-layer")
+	if err != nil {
+		return "", err
+	}
+
+	srcPath := filepath.Join(buildContext, src)
+	destPath := filepath.Join(layerDir, dest)
+
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return "", fmt.Errorf("stat %s: %w", srcPath, err)
+	}
+
+	if info.IsDir() {
+		if err := copyTree(srcPath, destPath); err != nil {
+			return "", err
+		}
+		return layerDir, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return "", err
+	}
+	if err := copyFile(srcPath, destPath); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(destPath, info.Mode()); err != nil {
+		return "", err
+	}
+
+	return layerDir, nil
+}
+
+// copyTree recursively copies the directory tree rooted at src to dst, preserving file modes.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(path, target); err != nil {
+			return err
+		}
+		return os.Chmod(target, info.Mode())
+	})
+}
+
+// normalizeEnvArg converts either Dockerfile ENV form into the "KEY=value" form Config.Env uses
+func normalizeEnvArg(args string) string {
+	if strings.Contains(args, "=") {
+		return args
+	}
+	if key, value, ok := strings.Cut(args, " "); ok {
+		return key + "=" + strings.TrimSpace(value)
+	}
+	return args
+}
+
+// parseCmdLike parses a CMD/ENTRYPOINT argument in JSON exec form or shell form
+func parseCmdLike(args string) []string {
+	trimmed := strings.TrimSpace(args)
+	if strings.HasPrefix(trimmed, "[") {
+		var execForm []string
+		if err := json.Unmarshal([]byte(trimmed), &execForm); err == nil {
+			return execForm
+		}
+	}
+	return []string{"/bin/sh", "-c", trimmed}
+}
+
+// instructionHistory renders one config history entry per Dockerfile instruction, in order.
+func instructionHistory(instructions []dockerfileInstruction) []map[string]interface{} {
+	history := make([]map[string]interface{}, 0, len(instructions))
+	createdAt := time.Now().UTC().Format(time.RFC3339Nano)
+	for _, instr := range instructions {
+		history = append(history, map[string]interface{}{
+			"created":    createdAt,
+			"created_by": strings.TrimSpace(instr.Op + " " + instr.Args),
+		})
+	}
+	return history
+}
+
+// appendHistory bumps an image config's rootfs.diff_ids and history for one additional layer, in place
+func appendHistory(config map[string]interface{}, diffID, createdBy string) {
+	rootfs, _ := config["rootfs"].(map[string]interface{})
+	if rootfs == nil {
+		rootfs = map[string]interface{}{"type": "layers"}
+	}
+	diffIDs, _ := rootfs["diff_ids"].([]interface{})
+	rootfs["diff_ids"] = append(diffIDs, diffID)
+	config["rootfs"] = rootfs
+
+	history, _ := config["history"].([]interface{})
+	history = append(history, map[string]interface{}{
+		"created":    time.Now().UTC().Format(time.RFC3339Nano),
+		"created_by": createdBy,
+	})
+	config["history"] = history
+}
+
+// ociLayerBlob is a layer ready to be written into an OCI image layout's blob store.
+type ociLayerBlob struct {
+	Digest string
+	Data   []byte
+}
+
+// tarGzDir tars and gzips dir's contents, returning the compressed bytes and the uncompressed tar's diffID
+func tarGzDir(dir string) ([]byte, string, error) {
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		// Overlayfs marks a deleted file as a character device with major:minor 0:0; translate
+		// that into the OCI/AUFS ".wh.<name>" whiteout entry instead of tarring the device node.
+		if info.Mode()&os.ModeCharDevice != 0 {
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Rdev == 0 {
+				return tw.WriteHeader(&tar.Header{
+					Name:     filepath.Join(filepath.Dir(rel), whiteoutPrefix+filepath.Base(rel)),
+					Typeflag: tar.TypeReg,
+					Mode:     0644,
+				})
+			}
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = rel
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			if _, err := io.Copy(tw, file); err != nil {
+				return err
+			}
+		}
+
+		// Overlayfs marks a directory's opaque deletion via the trusted.overlay.opaque xattr;
+		// translate that into the OCI/AUFS ".wh..wh..opq" marker entry inside the directory.
+		if info.IsDir() {
+			buf := make([]byte, 8)
+			if n, err := syscall.Getxattr(path, "trusted.overlay.opaque", buf); err == nil && n > 0 && buf[0] == 'y' {
+				if err := tw.WriteHeader(&tar.Header{
+					Name:     filepath.Join(rel, whiteoutOpaqueMarker),
+					Typeflag: tar.TypeReg,
+					Mode:     0644,
+				}); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("tar %s: %w", dir, err)
+	}
+	if err := tw.Close(); err != nil {
+		return nil, "", err
+	}
+
+	diffID := digestOf(tarBuf.Bytes())
+
+	var gzBuf bytes.Buffer
+	gw := gzip.NewWriter(&gzBuf)
+	if _, err := gw.Write(tarBuf.Bytes()); err != nil {
+		return nil, "", err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, "", err
+	}
+
+	return gzBuf.Bytes(), diffID, nil
+}
+
+// digestOf returns a blob's content address in "sha256:<hex>" form.
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// sanitizeImageRef turns an image reference into a filesystem-safe directory name.
+func sanitizeImageRef(ref string) string {
+	return strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(ref)
+}
+
+// writeOCIImageLayout writes a complete OCI image layout under ~/.mini-docker/images/<ref>/
+func writeOCIImageLayout(ref string, configBytes []byte, layers []ociLayerBlob) (string, error) {
+	root, err := imagesRoot()
+	if err != nil {
+		return "", err
+	}
+
+	imageDir := filepath.Join(root, sanitizeImageRef(ref))
+	blobsDir := filepath.Join(imageDir, "blobs", "sha256")
+	if err := os.MkdirAll(blobsDir, 0755); err != nil {
+		return "", err
+	}
+
+	configDigest := digestOf(configBytes)
+	if err := os.WriteFile(filepath.Join(blobsDir, strings.TrimPrefix(configDigest, "sha256:")), configBytes, 0644); err != nil {
+		return "", err
+	}
+
+	manifest := OCIManifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.manifest.v1+json",
+		Config: OCIDescriptor{
+			MediaType: "application/vnd.oci.image.config.v1+json",
+			Digest:    configDigest,
+			Size:      int64(len(configBytes)),
+		},
+	}
+
+	for _, layer := range layers {
+		if err := os.WriteFile(filepath.Join(blobsDir, strings.TrimPrefix(layer.Digest, "sha256:")), layer.Data, 0644); err != nil {
+			return "", err
+		}
+		manifest.Layers = append(manifest.Layers, OCIDescriptor{
+			MediaType: "application/vnd.oci.image.layer.v1.tar+gzip",
+			Digest:    layer.Digest,
+			Size:      int64(len(layer.Data)),
+		})
+	}
+
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	manifestDigest := digestOf(manifestBytes)
+	if err := os.WriteFile(filepath.Join(blobsDir, strings.TrimPrefix(manifestDigest, "sha256:")), manifestBytes, 0644); err != nil {
+		return "", err
+	}
+
+	index := OCIImageIndex{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.index.v1+json",
+		Manifests: []OCIDescriptor{{
+			MediaType:   manifest.MediaType,
+			Digest:      manifestDigest,
+			Size:        int64(len(manifestBytes)),
+			Annotations: map[string]string{"org.opencontainers.image.ref.name": ref},
+		}},
+	}
+	indexBytes, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(imageDir, "index.json"), indexBytes, 0644); err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(filepath.Join(imageDir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`+"\n"), 0644); err != nil {
+		return "", err
+	}
+
+	return imageDir, nil
+}
+
+// generateContainerID returns a random 12-character hex container id
+func generateContainerID() (string, error) {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// setupCgroup creates a cgroup v2 slice and applies the requested memory/cpus/pids limits
+func setupCgroup(containerID, memory string, cpus float64, pids int) (string, error) {
+	if memory == "" && cpus == 0 && pids == 0 {
+		return "", nil
+	}
+
+	cgroupPath := filepath.Join(cgroupRoot, containerID)
+	if err := os.MkdirAll(cgroupPath, 0755); err != nil {
+		return "", fmt.Errorf("mkdir cgroup %s: %w", cgroupPath, err)
+	}
+
+	if memory != "" {
+		limit, err := parseMemoryLimit(memory)
+		if err != nil {
+			return "", fmt.Errorf("invalid --memory %q: %w", memory, err)
+		}
+		if err := os.WriteFile(filepath.Join(cgroupPath, "memory.max"), []byte(strconv.FormatInt(limit, 10)), 0644); err != nil {
+			return "", fmt.Errorf("write memory.max: %w", err)
+		}
+	}
+
+	if cpus > 0 {
+		const period = 100000
+		quota := int64(cpus * period)
+		if err := os.WriteFile(filepath.Join(cgroupPath, "cpu.max"), []byte(fmt.Sprintf("%d %d", quota, period)), 0644); err != nil {
+			return "", fmt.Errorf("write cpu.max: %w", err)
+		}
+	}
+
+	if pids > 0 {
+		if err := os.WriteFile(filepath.Join(cgroupPath, "pids.max"), []byte(strconv.Itoa(pids)), 0644); err != nil {
+			return "", fmt.Errorf("write pids.max: %w", err)
+		}
 	}
 
-	// Make directory chroot
-	if err := syscall.Chroot(chrootDir); err != nil {
-		fmt.Fprint(os.Stderr, "Chroot failed: %v\n", err)
-		os.Exit(1)
+	return cgroupPath, nil
+}
+
+// teardownCgroup removes a cgroup directory created by setupCgroup
+func teardownCgroup(cgroupPath string) error {
+	if cgroupPath == "" {
+		return nil
 	}
+	return os.Remove(cgroupPath)
+}
 
-	// Change current directory (path) to '/'
-	if err := os.Chdir("/"); err != nil {
-		fmt.Fprintf(os.Stderr, "Chdir failed: %v\n", err)
-		os.Exit(1)
+// parseMemoryLimit parses a Docker-style memory limit ("256m", "1g", or a bare byte count)
+func parseMemoryLimit(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	multiplier := int64(1)
+
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			multiplier = 1024
+			s = s[:len(s)-1]
+		case 'm', 'M':
+			multiplier = 1024 * 1024
+			s = s[:len(s)-1]
+		case 'g', 'G':
+			multiplier = 1024 * 1024 * 1024
+			s = s[:len(s)-1]
+		}
 	}
 
-	// Prepare cmd struct - pipe standard FD
-	cmd := exec.Command(command, args...)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	cmd.Stdin = os.Stdin
+	value, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return value * multiplier, nil
+}
 
-	// Create PID namespace and unified time shared namespace (host)
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID,
+// parseImageReference parses `[registry[:port]/]repo[/subrepo]:tag[@digest]` into its parts
+func parseImageReference(imageString string) (ImageReference, error) {
+	ref := ImageReference{
+		Registry: defaultRegistry,
+		Tag:      "latest",
 	}
 
+	rest := imageString
+	if at := strings.LastIndex(rest, "@"); at != -1 {
+		ref.Digest = rest[at+1:]
+		rest = rest[:at]
+	}
 
-	// Run the command - fork + execvp
-	if err := cmd.Run(); err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			os.Exit(exitErr.ExitCode())
+	firstSlash := strings.Index(rest, "/")
+	if firstSlash != -1 {
+		candidate := rest[:firstSlash]
+		if strings.ContainsAny(candidate, ".:") || candidate == "localhost" {
+			ref.Registry = candidate
+			rest = rest[firstSlash+1:]
 		}
-		os.Exit(1)
 	}
 
-}
+	// The tag separator is the last colon after the final slash, so registry ports
+	// (already consumed above) and tags are never confused.
+	lastSlash := strings.LastIndex(rest, "/")
+	if colon := strings.LastIndex(rest, ":"); colon != -1 && colon > lastSlash {
+		ref.Tag = rest[colon+1:]
+		rest = rest[:colon]
+	}
+
+	if rest == "" {
+		return ImageReference{}, fmt.Errorf("empty repository in image reference %q", imageString)
+	}
 
+	// Docker Hub's official images live under "library/" when no namespace is given.
+	if ref.Registry == defaultRegistry && !strings.Contains(rest, "/") {
+		rest = "library/" + rest
+	}
+	ref.Repository = rest
+
+	return ref, nil
+}
 
-// Get manifest struct
-func getImageManifest(imageName, imageVersion, token string) (Manifest, error) {
+// getImageManifest resolves the manifest digest for the current platform and fetches the image manifest
+func getImageManifest(ref ImageReference, token string) (Manifest, error) {
 
-	digest, err := getManifestUrl(imageName, imageVersion, token)
+	digest, err := getManifestUrl(ref, token)
 	if err != nil {
 		return Manifest{}, err
 	}
 
-	manifestURL := fmt.Sprintf(
-		"https://registry.hub.docker.com/v2/library/%s/manifests/%s",
-		imageName,
-		digest,
-	)
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.Registry, ref.Repository, digest)
 
 	req, err := http.NewRequest("GET", manifestURL, nil)
 	if err != nil {
@@ -169,7 +1207,7 @@ func getImageManifest(imageName, imageVersion, token string) (Manifest, error) {
 	}
 
 	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+	req.Header.Set("Accept", manifestAcceptHeader)
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -178,6 +1216,11 @@ func getImageManifest(imageName, imageVersion, token string) (Manifest, error) {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return Manifest{}, fmt.Errorf("failed to fetch manifest (%d): %s", resp.StatusCode, string(body))
+	}
+
 	var manifest Manifest
 	err = json.NewDecoder(resp.Body).Decode(&manifest)
 	if err != nil {
@@ -187,15 +1230,17 @@ func getImageManifest(imageName, imageVersion, token string) (Manifest, error) {
 	return manifest, nil
 }
 
-// Get manifest url from returned manifest list, based on system architecture and OS
-func getManifestUrl(imageName, imageVersion, token string) (string, error) {
+// getManifestUrl resolves a manifest list/image index entry to the matching platform's digest
+func getManifestUrl(ref ImageReference, token string) (string, error) {
 
 	systemOS, systemArch := runtime.GOOS, runtime.GOARCH
-	manifestURL := fmt.Sprintf(
-		"https://registry.hub.docker.com/v2/library/%s/manifests/%s",
-		imageName,
-		imageVersion,
-	)
+
+	tagOrDigest := ref.Tag
+	if ref.Digest != "" {
+		tagOrDigest = ref.Digest
+	}
+
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.Registry, ref.Repository, tagOrDigest)
 
 	req, err := http.NewRequest("GET", manifestURL, nil)
 	if err != nil {
@@ -203,7 +1248,7 @@ func getManifestUrl(imageName, imageVersion, token string) (string, error) {
 	}
 
 	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.list.v2+json")
+	req.Header.Set("Accept", manifestAcceptHeader)
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -217,34 +1262,59 @@ func getManifestUrl(imageName, imageVersion, token string) (string, error) {
 		return "", fmt.Errorf("failed to fetch manifest list (%d): %s", resp.StatusCode, string(body))
 	}
 
-	var manifestList ManifestList
-	err = json.NewDecoder(resp.Body).Decode(&manifestList)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return "", err
 	}
 
+	contentType := resp.Header.Get("Content-Type")
+	if contentType != "application/vnd.docker.distribution.manifest.list.v2+json" &&
+		contentType != "application/vnd.oci.image.index.v1+json" {
+		// Already a single-platform manifest - nothing to resolve.
+		return tagOrDigest, nil
+	}
+
+	var manifestList ManifestList
+	if err := json.Unmarshal(body, &manifestList); err != nil {
+		return "", err
+	}
+
 	for _, manifest := range manifestList.Manifests {
 		if manifest.Platform.Architecture == systemArch && manifest.Platform.OS == systemOS {
 			return manifest.Digest, nil
 		}
 	}
 
-	return "", fmt.Errorf("Manifest not found")
+	return "", fmt.Errorf("manifest not found for %s/%s", systemOS, systemArch)
 
 }
 
-// Get authentication token for image:pull
-func getAuthToken(imageName string) (string, error) {
-	if !strings.Contains(imageName, "/") {
-		imageName = "library/" + imageName
+// getAuthToken performs Bearer-token discovery against the registry and exchanges it for a pull token
+func getAuthToken(ref ImageReference) (string, error) {
+	realm, service, err := getAuthChallenge(ref.Registry)
+	if err != nil {
+		return "", fmt.Errorf("failed to discover auth challenge: %w", err)
+	}
+	if realm == "" {
+		// No challenge issued (e.g. an unauthenticated registry) - nothing to exchange.
+		return "", nil
+	}
+
+	scope := fmt.Sprintf("repository:%s:pull", ref.Repository)
+	authURL := fmt.Sprintf("%s?service=%s&scope=%s", realm, service, scope)
+
+	req, err := http.NewRequest("GET", authURL, nil)
+	if err != nil {
+		return "", err
 	}
 
-	authURL := fmt.Sprintf(
-		"https://auth.docker.io/token?service=registry.docker.io&scope=repository:%s:pull",
-		imageName,
-	)
+	if basicAuth, ok, err := getDockerConfigAuth(ref.Registry); err != nil {
+		return "", fmt.Errorf("failed to read docker config: %w", err)
+	} else if ok {
+		req.Header.Set("Authorization", "Basic "+basicAuth)
+	}
 
-	resp, err := http.Get(authURL)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("failed to get token: %w", err)
 	}
@@ -255,65 +1325,431 @@ func getAuthToken(imageName string) (string, error) {
 	}
 
 	var data struct {
-		Token string `json:"token"`
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
 		return "", fmt.Errorf("failed to decode token response: %w", err)
 	}
 
-	return data.Token, nil
+	if data.Token != "" {
+		return data.Token, nil
+	}
+	return data.AccessToken, nil
+}
+
+// getAuthChallenge probes `GET /v2/` on the registry and parses the WWW-Authenticate Bearer challenge
+func getAuthChallenge(registry string) (realm string, service string, err error) {
+	resp, err := http.Get(fmt.Sprintf("https://%s/v2/", registry))
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		return "", "", nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", "", fmt.Errorf("unsupported auth challenge: %s", challenge)
+	}
+
+	params := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+
+	return params["realm"], params["service"], nil
 }
 
-// Parse imageString in order to return name and version of the image (ubuntu:latest) -> ubuntu, latest
-func getImageNameAndVersion(imageString string) (string, string, error) {
-	if !strings.Contains(imageString, ":") {
-		return imageString, "latest", nil
+// getDockerConfigAuth looks up ~/.docker/config.json for a registry's stored credentials
+func getDockerConfigAuth(registry string) (string, bool, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", false, err
+	}
+
+	configPath := filepath.Join(home, ".docker", "config.json")
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", false, err
+	}
+
+	keys := []string{registry}
+	if registry == defaultRegistry {
+		// docker login stores Docker Hub credentials under its legacy v1 URL, not the v2 API host.
+		keys = append(keys, "https://index.docker.io/v1/", "index.docker.io")
 	}
-	parts := strings.Split(imageString, ":")
-	imageName, imageVersion := parts[0], parts[1]
 
-	return imageName, imageVersion, nil
+	var entry struct {
+		Auth string `json:"auth"`
+	}
+	found := false
+	for _, key := range keys {
+		if e, ok := config.Auths[key]; ok && e.Auth != "" {
+			entry, found = e, true
+			break
+		}
+	}
+	if !found {
+		return "", false, nil
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(entry.Auth); err != nil {
+		return "", false, fmt.Errorf("invalid auth entry for %s: %w", registry, err)
+	}
+
+	return entry.Auth, true, nil
 }
 
-// Fetch and extract into chroot directory all image layers
-func getAllLayers(manifest Manifest, imageName, token, jailPath string) error {
-	client := &http.Client{}
+// fetchImageConfig downloads and verifies the image config blob referenced by a manifest, also returning its raw bytes
+func fetchImageConfig(ref ImageReference, token, digest string) (ImageConfig, []byte, error) {
+	if digest == "" {
+		return ImageConfig{}, nil, nil
+	}
 
-	for _, layer := range manifest.Layers {
-		layerURL := fmt.Sprintf(
-			"https://registry.hub.docker.com/v2/library/%s/blobs/%s",
-			imageName,
-			layer.Digest,
-		)
-		req, err := http.NewRequest("GET", layerURL, nil)
-		if err != nil {
-			return err
+	blobURL := fmt.Sprintf("https://%s/v2/%s/blobs/%s", ref.Registry, ref.Repository, digest)
+	req, err := http.NewRequest("GET", blobURL, nil)
+	if err != nil {
+		return ImageConfig{}, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return ImageConfig{}, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return ImageConfig{}, nil, fmt.Errorf("failed to fetch image config (%d): %s", resp.StatusCode, string(body))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ImageConfig{}, nil, err
+	}
+
+	sum := sha256.Sum256(body)
+	if hex.EncodeToString(sum[:]) != strings.TrimPrefix(digest, "sha256:") {
+		return ImageConfig{}, nil, fmt.Errorf("digest mismatch for image config %s", digest)
+	}
+
+	var imageConfig ImageConfig
+	if err := json.Unmarshal(body, &imageConfig); err != nil {
+		return ImageConfig{}, nil, err
+	}
+
+	return imageConfig, body, nil
+}
+
+// resolveUser parses a Config.User spec ("user", "uid", "user:group" or "uid:gid") into a uid/gid pair
+func resolveUser(spec string) (int, int, error) {
+	userPart, groupPart := spec, ""
+	if idx := strings.Index(spec, ":"); idx != -1 {
+		userPart, groupPart = spec[:idx], spec[idx+1:]
+	}
+
+	uid, gid, err := lookupUser(userPart)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if groupPart != "" {
+		if n, err := strconv.Atoi(groupPart); err == nil {
+			gid = n
+		} else if gid, err = lookupGroup(groupPart); err != nil {
+			return 0, 0, err
 		}
+	}
+
+	return uid, gid, nil
+}
+
+// lookupUser resolves a username or numeric uid to its uid/gid by reading /etc/passwd
+func lookupUser(user string) (int, int, error) {
+	uid, isNumeric := -1, false
+	if n, err := strconv.Atoi(user); err == nil {
+		uid, isNumeric = n, true
+	}
 
-		req.Header.Set("Authorization", "Bearer "+token)
+	data, err := os.ReadFile("/etc/passwd")
+	if err != nil {
+		if isNumeric {
+			return uid, 0, nil
+		}
+		return 0, 0, fmt.Errorf("read /etc/passwd: %w", err)
+	}
 
-		resp, err := client.Do(req)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 4 {
+			continue
+		}
+		if isNumeric {
+			if fields[2] != user {
+				continue
+			}
+		} else if fields[0] != user {
+			continue
+		}
+		entryUID, err := strconv.Atoi(fields[2])
 		if err != nil {
-			return err
+			return 0, 0, fmt.Errorf("malformed uid for user %s: %w", user, err)
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return 0, 0, fmt.Errorf("malformed gid for user %s: %w", user, err)
 		}
+		return entryUID, gid, nil
+	}
+
+	if isNumeric {
+		return uid, 0, nil
+	}
+	return 0, 0, fmt.Errorf("user %q not found in /etc/passwd", user)
+}
 
-		defer resp.Body.Close()
+// lookupGroup resolves a group name to its gid by reading /etc/group.
+func lookupGroup(group string) (int, error) {
+	data, err := os.ReadFile("/etc/group")
+	if err != nil {
+		return 0, fmt.Errorf("read /etc/group: %w", err)
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			return fmt.Errorf("failed to download layer: %s (%d): %s", layer.Digest, resp.StatusCode, string(body))
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 || fields[0] != group {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, fmt.Errorf("malformed gid for group %s: %w", group, err)
 		}
+		return gid, nil
+	}
+
+	return 0, fmt.Errorf("group %q not found in /etc/group", group)
+}
+
+// getAllLayers fetches and extracts every image layer, in manifest order, for use as overlay lowerdirs
+func getAllLayers(manifest Manifest, ref ImageReference, token, layersDir string) ([]string, error) {
+	cachedPaths := make([]string, len(manifest.Layers))
+	pullErrs := make([]error, len(manifest.Layers))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentLayerPulls)
+
+	for i, layer := range manifest.Layers {
+		wg.Add(1)
+		go func(i int, digest string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			cachedPaths[i], pullErrs[i] = fetchLayer(ref, token, digest)
+		}(i, layer.Digest)
+	}
+	wg.Wait()
 
-		err = extractTarGz(resp.Body, jailPath)
+	for i, err := range pullErrs {
 		if err != nil {
-			return fmt.Errorf("error extracting layer %s: %v", layer.Digest, err)
+			return nil, fmt.Errorf("error fetching layer %s: %w", manifest.Layers[i].Digest, err)
+		}
+	}
+
+	layerDirs := make([]string, len(manifest.Layers))
+	for i, layer := range manifest.Layers {
+		layerDir := filepath.Join(layersDir, strings.TrimPrefix(layer.Digest, "sha256:"))
+		if err := os.MkdirAll(layerDir, 0755); err != nil {
+			return nil, fmt.Errorf("mkdir layer dir %s: %w", layerDir, err)
 		}
+		if err := applyLayer(cachedPaths[i], layerDir); err != nil {
+			return nil, fmt.Errorf("error extracting layer %s: %w", layer.Digest, err)
+		}
+		layerDirs[i] = layerDir
+	}
+
+	return layerDirs, nil
+}
+
+// applyLayer extracts an already-downloaded, cached layer tarball into its own layer directory.
+func applyLayer(cachedPath, layerDir string) error {
+	file, err := os.Open(cachedPath)
+	if err != nil {
+		return fmt.Errorf("open cached layer %s: %w", cachedPath, err)
+	}
+	defer file.Close()
+
+	return extractTarGz(file, layerDir)
+}
+
+// mountOverlay mounts an OverlayFS rootfs stacking lowerDirs underneath upperDir as the writable layer
+func mountOverlay(lowerDirs []string, upperDir, workDir, mergedDir string) error {
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowerDirs, ":"), upperDir, workDir)
+	if err := syscall.Mount("overlay", mergedDir, "overlay", 0, options); err != nil {
+		return fmt.Errorf("mount overlay at %s: %w", mergedDir, err)
 	}
+	return nil
+}
 
+// unmountOverlay tears down a rootfs mounted by mountOverlay
+func unmountOverlay(mergedDir string) error {
+	if err := syscall.Unmount(mergedDir, 0); err != nil {
+		return fmt.Errorf("unmount overlay at %s: %w", mergedDir, err)
+	}
 	return nil
 }
 
+// reverseStrings returns a new slice with s in reverse order, without mutating s.
+func reverseStrings(s []string) []string {
+	reversed := make([]string, len(s))
+	for i, v := range s {
+		reversed[len(s)-1-i] = v
+	}
+	return reversed
+}
+
+// fetchLayer returns the layer blob's path on disk, downloading and verifying it only on a cache miss
+func fetchLayer(ref ImageReference, token, digest string) (string, error) {
+	cachePath, err := layerCachePath(digest)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(cachePath); err == nil {
+		return cachePath, nil
+	}
+
+	layerURL := fmt.Sprintf("https://%s/v2/%s/blobs/%s", ref.Registry, ref.Repository, digest)
+	req, err := http.NewRequest("GET", layerURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("failed to download layer: %s (%d): %s", digest, resp.StatusCode, string(body))
+	}
+
+	wantSum := strings.TrimPrefix(digest, "sha256:")
+
+	// Download into a temp file next to the cache (same dir, so the final rename is atomic),
+	// hashing as we go so a corrupt or tampered blob never reaches the cache under its digest.
+	tmp, err := os.CreateTemp(filepath.Dir(cachePath), "blob-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // no-op once renamed into place
+
+	hasher := sha256.New()
+	if _, err := io.Copy(tmp, io.TeeReader(resp.Body, hasher)); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("write blob %s: %w", digest, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	gotSum := hex.EncodeToString(hasher.Sum(nil))
+	if gotSum != wantSum {
+		return "", fmt.Errorf("digest mismatch for layer %s: got sha256:%s", digest, gotSum)
+	}
+
+	if err := os.Rename(tmpPath, cachePath); err != nil {
+		return "", fmt.Errorf("cache blob %s: %w", digest, err)
+	}
+
+	return cachePath, nil
+}
+
+// layerCachePath returns the on-disk path for a content-addressed layer blob, creating its parent directory if needed
+func layerCachePath(digest string) (string, error) {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return "", fmt.Errorf("unsupported digest algorithm in %q", digest)
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(home, ".mini-docker", "layers", "sha256")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, strings.TrimPrefix(digest, "sha256:")+".tar.gz"), nil
+}
+
+// miniDockerHome returns ~/.mini-docker, the root of mini-docker's on-disk state
+func miniDockerHome() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".mini-docker"), nil
+}
+
+// containerDir returns the persistent directory for a container's rootfs state, creating it if needed
+func containerDir(containerID string) (string, error) {
+	home, err := miniDockerHome()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(home, containersDirName, containerID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// imagesRoot returns ~/.mini-docker/images, where `commit` and `build` write OCI image layouts.
+func imagesRoot() (string, error) {
+	home, err := miniDockerHome()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(home, imagesDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// AUFS-style whiteout markers, as written by the registry into layer tarballs and understood
+// natively by the Linux overlay filesystem driver once translated below.
+const (
+	whiteoutOpaqueMarker = ".wh..wh..opq"
+	whiteoutPrefix       = ".wh."
+)
+
 // Each image layer is .Tar file that has to be extracted - set chmod for every file
 func extractTarGz(gzipStream io.Reader, targetDir string) error {
 	gzReader, err := gzip.NewReader(gzipStream)
@@ -335,49 +1771,118 @@ func extractTarGz(gzipStream io.Reader, targetDir string) error {
 
 		targetPath := filepath.Join(targetDir, header.Name)
 
+		// Reject tar entries that would escape targetDir (a maliciously or buggily crafted
+		// "../../etc/passwd" style name), rather than trusting the archive's paths blindly.
+		if rel, err := filepath.Rel(targetDir, targetPath); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("tar entry %q escapes target directory", header.Name)
+		}
+
+		// An opaque-directory marker hides everything a lower layer put in this directory;
+		// overlayfs recognises that directly via the trusted.overlay.opaque xattr.
+		if filepath.Base(header.Name) == whiteoutOpaqueMarker {
+			parent := filepath.Dir(targetPath)
+			if err := syscall.Setxattr(parent, "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+				return fmt.Errorf("mark opaque dir %s: %w", parent, err)
+			}
+			continue
+		}
+
+		// A whiteout marker deletes a single entry from a lower layer; overlayfs recognises
+		// that as a character device with major:minor 0:0 in its place.
+		if strings.HasPrefix(filepath.Base(header.Name), whiteoutPrefix) {
+			whiteoutTarget := filepath.Join(filepath.Dir(targetPath), strings.TrimPrefix(filepath.Base(header.Name), whiteoutPrefix))
+			if err := syscall.Mknod(whiteoutTarget, syscall.S_IFCHR, 0); err != nil {
+				return fmt.Errorf("create whiteout %s: %w", whiteoutTarget, err)
+			}
+			continue
+		}
+
 		switch header.Typeflag {
 		case tar.TypeDir:
 			if err := os.MkdirAll(targetPath, header.FileInfo().Mode()); err != nil {
-				panic("failed to mkdir: " + err.Error())
+				return fmt.Errorf("mkdir %s: %w", targetPath, err)
 			}
 		case tar.TypeReg:
 			file, err := os.Create(targetPath)
 			if err != nil {
-				panic("failed to create: " + err.Error())
+				return fmt.Errorf("create %s: %w", targetPath, err)
 			}
 			if _, err := io.Copy(file, tarReader); err != nil {
-				panic("failed to copy: " + err.Error())
+				file.Close()
+				return fmt.Errorf("copy %s: %w", targetPath, err)
 			}
-			err = file.Close()
-			if err != nil {
-				panic("failed to close: " + err.Error())
+			if err := file.Close(); err != nil {
+				return fmt.Errorf("close %s: %w", targetPath, err)
 			}
 
 		case tar.TypeSymlink:
 			absolutePath := filepath.Join(targetDir, header.Linkname)
 			relativePath, err := filepath.Rel(filepath.Dir(targetPath), absolutePath)
 			if err != nil {
-				panic("failed relative: " + err.Error())
+				return fmt.Errorf("resolve symlink target for %s: %w", targetPath, err)
 			}
-			err = os.Symlink(relativePath, targetPath)
-			if err != nil {
-				panic("failed symlink: " + err.Error())
+			if err := os.Symlink(relativePath, targetPath); err != nil {
+				return fmt.Errorf("symlink %s: %w", targetPath, err)
+			}
+
+		case tar.TypeLink:
+			linkTarget := filepath.Join(targetDir, header.Linkname)
+			if err := os.Link(linkTarget, targetPath); err != nil {
+				return fmt.Errorf("hardlink %s: %w", targetPath, err)
+			}
+
+		case tar.TypeChar, tar.TypeBlock:
+			mode := uint32(syscall.S_IFCHR)
+			if header.Typeflag == tar.TypeBlock {
+				mode = syscall.S_IFBLK
+			}
+			dev := int(makedev(uint32(header.Devmajor), uint32(header.Devminor)))
+			if err := syscall.Mknod(targetPath, mode, dev); err != nil && err != syscall.EPERM {
+				return fmt.Errorf("mknod %s: %w", targetPath, err)
+			}
+
+		case tar.TypeFifo:
+			if err := syscall.Mkfifo(targetPath, uint32(header.FileInfo().Mode())); err != nil {
+				return fmt.Errorf("mkfifo %s: %w", targetPath, err)
 			}
+
+		case tar.TypeXGlobalHeader, tar.TypeXHeader:
+			// Pax extended headers are already folded into header.PAXRecords by tarReader; nothing
+			// to materialize on disk.
+			continue
+
 		default:
-			// Other types can be added here
+			// Unrecognized entry types (vendor extensions, types archive/tar hasn't folded away
+			// already) shouldn't abort extraction of the rest of the layer.
+			fmt.Fprintf(os.Stderr, "Skipping unsupported tar entry type %q for %s\n", string(header.Typeflag), header.Name)
+			continue
 		}
 
-		err = os.Chmod(targetPath, header.FileInfo().Mode())
-		if err != nil {
-			if !os.IsNotExist(err) {
-				panic("failed to chmod: " + err.Error())
+		for key, value := range header.PAXRecords {
+			const xattrPrefix = "SCHILY.xattr."
+			if !strings.HasPrefix(key, xattrPrefix) {
+				continue
+			}
+			name := strings.TrimPrefix(key, xattrPrefix)
+			if err := syscall.Setxattr(targetPath, name, []byte(value), 0); err != nil && err != syscall.EPERM {
+				return fmt.Errorf("setxattr %s on %s: %w", name, targetPath, err)
 			}
 		}
+
+		if err := os.Chmod(targetPath, header.FileInfo().Mode()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("chmod %s: %w", targetPath, err)
+		}
 	}
 
 	return nil
 }
 
+// makedev combines a device's major/minor numbers into the dev_t value Mknod expects
+func makedev(major, minor uint32) uint64 {
+	return uint64(minor&0xff) | uint64(major&0xfff)<<8 |
+		uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32
+}
+
 // Copy file from src path to dst path
 func copyFile(src, dst string) error {
 	in, err := os.Open(src)
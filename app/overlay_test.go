@@ -0,0 +1,27 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReverseStrings(t *testing.T) {
+	cases := []struct {
+		in   []string
+		want []string
+	}{
+		{[]string{"a", "b", "c"}, []string{"c", "b", "a"}},
+		{[]string{"only"}, []string{"only"}},
+		{nil, []string{}},
+	}
+
+	for _, tc := range cases {
+		got := reverseStrings(tc.in)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("reverseStrings(%v) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "testing"
+
+func TestMakedev(t *testing.T) {
+	cases := []struct {
+		major, minor uint32
+		want         uint64
+	}{
+		{0, 0, 0},
+		{1, 5, 0x105},
+		{8, 1, 0x801},
+	}
+	for _, tc := range cases {
+		if got := makedev(tc.major, tc.minor); got != tc.want {
+			t.Errorf("makedev(%d, %d) = %#x, want %#x", tc.major, tc.minor, got, tc.want)
+		}
+	}
+}
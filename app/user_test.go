@@ -0,0 +1,44 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "testing"
+
+func TestResolveUserNumericWithExplicitGroup(t *testing.T) {
+	uid, gid, err := resolveUser("0:0")
+	if err != nil {
+		t.Fatalf("resolveUser(\"0:0\") returned error: %v", err)
+	}
+	if uid != 0 || gid != 0 {
+		t.Errorf("resolveUser(\"0:0\") = (%d, %d), want (0, 0)", uid, gid)
+	}
+}
+
+func TestResolveUserUnknownUidWithExplicitGroup(t *testing.T) {
+	// Neither the uid nor the gid is expected to exist in /etc/passwd or /etc/group, so both
+	// values should simply be taken at face value.
+	uid, gid, err := resolveUser("424242:434343")
+	if err != nil {
+		t.Fatalf("resolveUser(\"424242:434343\") returned error: %v", err)
+	}
+	if uid != 424242 || gid != 434343 {
+		t.Errorf("resolveUser(\"424242:434343\") = (%d, %d), want (424242, 434343)", uid, gid)
+	}
+}
+
+func TestLookupUserUnknownNumericFallsBackToGidZero(t *testing.T) {
+	uid, gid, err := lookupUser("424242")
+	if err != nil {
+		t.Fatalf("lookupUser(\"424242\") returned error: %v", err)
+	}
+	if uid != 424242 || gid != 0 {
+		t.Errorf("lookupUser(\"424242\") = (%d, %d), want (424242, 0)", uid, gid)
+	}
+}
+
+func TestLookupUserUnknownNameErrors(t *testing.T) {
+	if _, _, err := lookupUser("definitely-not-a-real-user"); err == nil {
+		t.Error("lookupUser with an unknown username should return an error")
+	}
+}